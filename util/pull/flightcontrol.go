@@ -0,0 +1,167 @@
+package pull
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/util/flightcontrol"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Group deduplicates concurrent calls to Pull for the same (ref, platform)
+// across multiple Puller instances. Puller's own resolveOnce only collapses
+// repeat calls on a single instance; two builds that each construct their own
+// Puller for the same base image still race the registry and the content
+// store. It does not cover PullAllManifests, which walks a whole index in
+// one call and has no single (ref, platform) key to dedupe on. A Group is
+// meant to be held by the caller's source implementation (one per containerd
+// resolver/content-store pair) and shared across pulls.
+type Group struct {
+	g     flightcontrol.Group
+	ttl   time.Duration
+	mu    sync.Mutex
+	cache map[string]*groupEntry
+}
+
+// groupEntry owns the one real PulledManifests.Done for every caller that
+// was handed this pull's result, whether they got it by racing into the same
+// flightcontrol.Do call or by hitting the ttl cache afterwards. Each caller
+// is instead given a per-caller Done (see public) that only decrements
+// pending; realDone only runs once the entry has both expired from the cache
+// and every caller that was handed it has called their Done, so a fast
+// caller releasing early can't pull the lease out from under a slower one
+// still holding the same cached result.
+type groupEntry struct {
+	pm       *PulledManifests
+	realDone func(context.Context) error
+	expires  time.Time
+
+	mu       sync.Mutex
+	pending  int
+	expired  bool
+	released bool
+}
+
+// public returns a PulledManifests for a new caller of this entry's result,
+// with Done wired to this entry's refcounted release instead of the
+// underlying realDone directly.
+func (e *groupEntry) public() *PulledManifests {
+	e.mu.Lock()
+	e.pending++
+	e.mu.Unlock()
+
+	pub := *e.pm
+	pub.Done = func(ctx context.Context) error {
+		e.mu.Lock()
+		e.pending--
+		release := e.expired && e.pending == 0 && !e.released
+		if release {
+			e.released = true
+		}
+		e.mu.Unlock()
+		if release {
+			return e.realDone(ctx)
+		}
+		return nil
+	}
+	return &pub
+}
+
+// expire marks the entry as evicted from the cache and releases it
+// immediately if every caller it was ever handed to has already called
+// Done.
+func (e *groupEntry) expire() {
+	e.mu.Lock()
+	e.expired = true
+	release := e.pending == 0 && !e.released
+	if release {
+		e.released = true
+	}
+	e.mu.Unlock()
+	if release {
+		go e.realDone(context.Background())
+	}
+}
+
+// NewGroup returns a Group that, in addition to collapsing concurrent pulls,
+// serves a cached PulledManifests for ttl after it completes. A ttl of zero
+// still protects concurrent callers that raced into the same pull (they all
+// share one lease release), it just doesn't serve the result to callers
+// arriving afterwards.
+func NewGroup(ttl time.Duration) *Group {
+	return &Group{ttl: ttl, cache: map[string]*groupEntry{}}
+}
+
+// Pull calls p.PullManifests, deduplicating against any other Pull call
+// currently in flight for the same (ref, platform) and, within the group's
+// ttl, short-circuiting repeat calls entirely. The PulledManifests returned
+// to the caller has its own Done; the underlying pull's lease is only
+// released once every caller that shared the result has called Done and the
+// Group has evicted the entry, regardless of how many callers that was.
+func (g *Group) Pull(ctx context.Context, p *Puller) (*PulledManifests, error) {
+	key := groupKey(p.Src.String(), p.Platform)
+
+	g.mu.Lock()
+	g.evictExpiredLocked()
+	if e, ok := g.cache[key]; ok {
+		// public's pending-increment must happen under g.mu, in the same
+		// critical section as the cache lookup: otherwise a concurrent
+		// Pull's evictExpiredLocked could see e.pending still at zero and
+		// release e's lease in the gap between us finding e in the cache
+		// and us registering as one of its pending callers.
+		pub := e.public()
+		g.mu.Unlock()
+		return pub, nil
+	}
+	g.mu.Unlock()
+
+	res, err := g.g.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return p.PullManifests(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	pm := res.(*PulledManifests)
+
+	expires := time.Now()
+	if g.ttl > 0 {
+		expires = expires.Add(g.ttl)
+	}
+	e := &groupEntry{pm: pm, realDone: pm.Done, expires: expires}
+
+	g.mu.Lock()
+	// Another waiter that raced into the same Do call may have already
+	// installed an entry for key; keep whichever is there so there is a
+	// single realDone per underlying pull.
+	if existing, ok := g.cache[key]; ok {
+		e = existing
+	} else {
+		g.cache[key] = e
+	}
+	// Same reasoning as above: bump pending before releasing g.mu so this
+	// entry can't be evicted and released out from under us first.
+	pub := e.public()
+	g.mu.Unlock()
+
+	return pub, nil
+}
+
+// evictExpiredLocked drops cache entries past their ttl and expires each one,
+// releasing its lease once every caller it was handed to has called Done.
+// Called with g.mu held.
+func (g *Group) evictExpiredLocked() {
+	now := time.Now()
+	for key, e := range g.cache {
+		if now.Before(e.expires) {
+			continue
+		}
+		delete(g.cache, key)
+		e.expire()
+	}
+}
+
+func groupKey(ref string, platform ocispec.Platform) string {
+	return ref + "::" + platforms.Format(platform)
+}
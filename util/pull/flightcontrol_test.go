@@ -0,0 +1,110 @@
+package pull
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func waitReleased(t *testing.T, released chan struct{}) {
+	t.Helper()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for release")
+	}
+}
+
+func TestGroupEntryWaitsForEveryCallerBeforeReleasing(t *testing.T) {
+	released := make(chan struct{})
+	e := &groupEntry{
+		pm:       &PulledManifests{},
+		realDone: func(context.Context) error { close(released); return nil },
+	}
+
+	a := e.public()
+	b := e.public()
+
+	e.expire()
+	select {
+	case <-released:
+		t.Fatal("expected release to wait for every outstanding caller, not just expiry")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := a.Done(context.Background()); err != nil {
+		t.Fatalf("Done returned error: %v", err)
+	}
+	select {
+	case <-released:
+		t.Fatal("expected release to wait for every caller's Done, not just the first")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := b.Done(context.Background()); err != nil {
+		t.Fatalf("Done returned error: %v", err)
+	}
+	waitReleased(t, released)
+}
+
+func TestGroupEntryReleasesImmediatelyOnExpireIfAlreadyDone(t *testing.T) {
+	released := make(chan struct{})
+	e := &groupEntry{
+		pm:       &PulledManifests{},
+		realDone: func(context.Context) error { close(released); return nil },
+	}
+
+	p := e.public()
+	if err := p.Done(context.Background()); err != nil {
+		t.Fatalf("Done returned error: %v", err)
+	}
+	select {
+	case <-released:
+		t.Fatal("should not release before the entry expires")
+	default:
+	}
+
+	e.expire()
+	waitReleased(t, released)
+}
+
+func TestGroupPullCacheHitRegistersPendingBeforeReturning(t *testing.T) {
+	g := NewGroup(time.Hour)
+
+	released := make(chan struct{})
+	e := &groupEntry{
+		pm:       &PulledManifests{},
+		realDone: func(context.Context) error { close(released); return nil },
+		expires:  time.Now().Add(time.Hour),
+	}
+
+	spec, err := reference.Parse("example.com/foo:latest")
+	if err != nil {
+		t.Fatalf("reference.Parse returned error: %v", err)
+	}
+	p := &Puller{Src: spec}
+	g.cache[groupKey(p.Src.String(), p.Platform)] = e
+
+	pub, err := g.Pull(context.Background(), p)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+
+	// By the time Pull has returned, the caller it handed pub to must
+	// already be registered as pending on e: an expiry racing in right
+	// after Pull returns (as a concurrent Pull's evictExpiredLocked would)
+	// must not release the entry while pub is still outstanding.
+	e.expire()
+	select {
+	case <-released:
+		t.Fatal("expected release to wait for the caller Pull just returned")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := pub.Done(context.Background()); err != nil {
+		t.Fatalf("Done returned error: %v", err)
+	}
+	waitReleased(t, released)
+}
@@ -0,0 +1,120 @@
+package pull
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/moby/buildkit/util/imageutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// manifestRefLabel tags a manifest/index blob in the content store with the
+// tag it was last resolved from, so a later pull of the same ref can find it
+// without talking to the registry.
+const manifestRefLabel = "buildkit.io/pull.manifest-ref"
+
+// ManifestStore is a thin, tag-keyed cache over a content.Store. Unlike the
+// store's native digest addressing, it lets a Puller look up the manifest it
+// last fetched for a tag (e.g. "alpine:latest") without knowing the digest up
+// front, so repeat pulls of the same tag can skip the registry GET as long as
+// a cheap resolve confirms the digest hasn't moved.
+type ManifestStore struct {
+	Store content.Store
+}
+
+// Get returns the cached manifest/index descriptor and bytes last stored for
+// ref, if any. Put guarantees at most one digest carries ref's label at a
+// time, so which match Walk visits last doesn't matter. The content store
+// doesn't record a blob's media type, so it is re-detected here (the same
+// way tryLocalResolve detects it for a digest-addressed pull) rather than
+// left zero-valued, which would make a manifest indistinguishable from an
+// index or config to callers that branch on desc.MediaType.
+func (ms *ManifestStore) Get(ctx context.Context, ref string) (ocispec.Descriptor, []byte, bool) {
+	var desc ocispec.Descriptor
+	found := false
+
+	err := ms.Store.Walk(ctx, func(info content.Info) error {
+		desc = ocispec.Descriptor{
+			Digest: info.Digest,
+			Size:   info.Size,
+		}
+		found = true
+		return nil
+	}, "labels.\""+manifestRefLabel+"\"=="+ref)
+	if err != nil || !found {
+		return ocispec.Descriptor{}, nil, false
+	}
+
+	ra, err := ms.Store.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, false
+	}
+	mt, err := imageutil.DetectManifestMediaType(ra)
+	ra.Close()
+	if err != nil {
+		return ocispec.Descriptor{}, nil, false
+	}
+	desc.MediaType = mt
+
+	dt, err := content.ReadBlob(ctx, ms.Store, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, false
+	}
+
+	return desc, dt, true
+}
+
+// Put labels the already-fetched manifest/index blob so that a subsequent
+// Get(ref) can find it again. The blob is expected to already exist in the
+// content store (PullManifests writes it as part of the regular fetch path);
+// Put only records the ref -> digest association. If ref's tag previously
+// resolved to a different digest, the label is cleared from that digest
+// first, so at most one blob ever carries it and Get can't serve whichever
+// one the store happens to visit last.
+func (ms *ManifestStore) Put(ctx context.Context, ref string, desc ocispec.Descriptor) error {
+	if err := ms.clearStaleLabel(ctx, ref, desc.Digest); err != nil {
+		return err
+	}
+
+	info := content.Info{
+		Digest: desc.Digest,
+		Labels: map[string]string{
+			manifestRefLabel: ref,
+		},
+	}
+	_, err := ms.Store.Update(ctx, info, "labels."+manifestRefLabel)
+	if err != nil {
+		return errors.Wrapf(err, "failed to label manifest for ref %s", ref)
+	}
+	return nil
+}
+
+// clearStaleLabel removes manifestRefLabel from any digest other than keep
+// that currently carries it for ref.
+func (ms *ManifestStore) clearStaleLabel(ctx context.Context, ref string, keep digest.Digest) error {
+	var stale []digest.Digest
+	err := ms.Store.Walk(ctx, func(info content.Info) error {
+		if info.Digest != keep {
+			stale = append(stale, info.Digest)
+		}
+		return nil
+	}, "labels.\""+manifestRefLabel+"\"=="+ref)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up existing manifest for ref %s", ref)
+	}
+
+	for _, d := range stale {
+		info := content.Info{
+			Digest: d,
+			Labels: map[string]string{
+				manifestRefLabel: "",
+			},
+		}
+		if _, err := ms.Store.Update(ctx, info, "labels."+manifestRefLabel); err != nil {
+			return errors.Wrapf(err, "failed to clear stale manifest label on %s", d)
+		}
+	}
+	return nil
+}
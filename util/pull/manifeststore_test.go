@@ -0,0 +1,170 @@
+package pull
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// fakeContentStore is a minimal, in-memory content.Store sufficient to
+// exercise ManifestStore's label-based lookups: Info/Update/Walk for
+// labels, and ReaderAt for the media-type sniff and blob read in Get. The
+// write-side ingest methods aren't used by ManifestStore and just error out.
+type fakeContentStore struct {
+	mu    sync.Mutex
+	blobs map[digest.Digest][]byte
+	info  map[digest.Digest]content.Info
+}
+
+func newFakeContentStore() *fakeContentStore {
+	return &fakeContentStore{
+		blobs: map[digest.Digest][]byte{},
+		info:  map[digest.Digest]content.Info{},
+	}
+}
+
+func (s *fakeContentStore) add(dt []byte) digest.Digest {
+	d := digest.FromBytes(dt)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[d] = dt
+	s.info[d] = content.Info{Digest: d, Size: int64(len(dt))}
+	return d
+}
+
+func (s *fakeContentStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.info[dgst]
+	if !ok {
+		return content.Info{}, errors.Errorf("content not found: %s", dgst)
+	}
+	return info, nil
+}
+
+func (s *fakeContentStore) Update(ctx context.Context, info content.Info, fieldpaths ...string) (content.Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing := s.info[info.Digest]
+	existing.Digest = info.Digest
+	if existing.Labels == nil {
+		existing.Labels = map[string]string{}
+	}
+	for _, fp := range fieldpaths {
+		const prefix = "labels."
+		if !strings.HasPrefix(fp, prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(fp, prefix)
+		if v := info.Labels[key]; v == "" {
+			delete(existing.Labels, key)
+		} else {
+			existing.Labels[key] = v
+		}
+	}
+	s.info[info.Digest] = existing
+	return existing, nil
+}
+
+var labelFilterRe = regexp.MustCompile(`^labels\."([^"]+)"==(.*)$`)
+
+func (s *fakeContentStore) Walk(ctx context.Context, fn content.WalkFunc, filters ...string) error {
+	s.mu.Lock()
+	infos := make([]content.Info, 0, len(s.info))
+	for _, info := range s.info {
+		infos = append(infos, info)
+	}
+	s.mu.Unlock()
+
+	for _, info := range infos {
+		matches := true
+		for _, f := range filters {
+			m := labelFilterRe.FindStringSubmatch(f)
+			if m == nil {
+				continue
+			}
+			if info.Labels[m[1]] != m[2] {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeContentStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	return errors.New("not implemented")
+}
+
+func (s *fakeContentStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[desc.Digest]
+	if !ok {
+		return nil, errors.Errorf("content not found: %s", desc.Digest)
+	}
+	return &fakeReaderAt{b: b}, nil
+}
+
+func (s *fakeContentStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeContentStore) Status(ctx context.Context, ref string) (content.Status, error) {
+	return content.Status{}, errors.New("not implemented")
+}
+
+func (s *fakeContentStore) ListStatuses(ctx context.Context, filters ...string) ([]content.Status, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeContentStore) Abort(ctx context.Context, ref string) error {
+	return errors.New("not implemented")
+}
+
+func TestManifestStorePutClearsStaleLabel(t *testing.T) {
+	store := newFakeContentStore()
+	ms := &ManifestStore{Store: store}
+
+	d1 := store.add([]byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","schemaVersion":2,"tag":"v1"}`))
+	d2 := store.add([]byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","schemaVersion":2,"tag":"v2"}`))
+
+	ref := "example.com/foo:latest"
+	if err := ms.Put(context.Background(), ref, ocispec.Descriptor{Digest: d1}); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	// The tag moves to a new digest, as happens when it's re-pushed.
+	if err := ms.Put(context.Background(), ref, ocispec.Descriptor{Digest: d2}); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	desc, _, ok := ms.Get(context.Background(), ref)
+	if !ok {
+		t.Fatal("expected Get to find the cached manifest")
+	}
+	if desc.Digest != d2 {
+		t.Fatalf("expected Get to return the latest digest %s, got %s", d2, desc.Digest)
+	}
+
+	info1, err := store.Info(context.Background(), d1)
+	if err != nil {
+		t.Fatalf("Info returned error: %v", err)
+	}
+	if _, ok := info1.Labels[manifestRefLabel]; ok {
+		t.Fatal("expected the stale digest's ref label to be cleared once the tag moved")
+	}
+}
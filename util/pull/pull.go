@@ -2,10 +2,16 @@ package pull
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/gc"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes"
@@ -14,18 +20,58 @@ import (
 	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/util/contentutil"
 	"github.com/moby/buildkit/util/imageutil"
+	"github.com/moby/buildkit/util/leaseutil"
+	"github.com/moby/buildkit/util/progress"
 	"github.com/moby/buildkit/util/pull/pullprogress"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 )
 
+// progressUpdateInterval bounds how often fetch progress is written to the
+// ProgressWriter. Descriptor reads happen far more often than a UI needs to
+// redraw, so updates are coalesced down to this interval.
+const progressUpdateInterval = 100 * time.Millisecond
+
 type Puller struct {
 	ContentStore content.Store
 	Resolver     remotes.Resolver
 	Src          reference.Spec
 	Platform     ocispec.Platform
 
+	// Platforms, when non-empty, is used by PullAllManifests instead of
+	// Platform to walk an index once and return a PulledManifests per
+	// matching platform.
+	Platforms []ocispec.Platform
+
+	// LeaseManager, when set, causes PullManifests to pin the fetched
+	// manifests and config inside a fresh lease for the duration of the
+	// pull. On success the lease is released via the Done func returned
+	// on PulledManifests, not by PullManifests itself, so callers can keep
+	// the content pinned until their cache records are in place; when
+	// PullManifests returns an error it releases the lease itself.
+	LeaseManager leases.Manager
+	// GarbageCollect is invoked after the lease backing a pull is deleted,
+	// if set. It allows the caller to trigger a GC pass (e.g. the cache
+	// manager's own garbage collector) right after manifest/config blobs
+	// lose their lease-based root.
+	GarbageCollect func(ctx context.Context) (gc.Stats, error)
+
+	// ManifestStore, when set, lets tag resolves reuse a manifest fetched
+	// on a previous pull instead of always falling through to a registry
+	// GET; tryLocalResolve only trusts the cached entry once a resolve
+	// confirms the digest is still current (or the registry is
+	// unreachable).
+	ManifestStore *ManifestStore
+
+	// ProgressWriter, when set, receives a fetchProgress (bytes read so far
+	// and total size) for each blob fetched while pulling manifests, keyed
+	// by descriptor digest, so a client can render pull progress alongside
+	// build step progress. No separate start or completed event is written;
+	// the report sent when a blob's read reaches EOF is the last for it.
+	ProgressWriter progress.Writer
+
 	resolveOnce sync.Once
 	resolveErr  error
 	desc        ocispec.Descriptor
@@ -43,6 +89,12 @@ type PulledManifests struct {
 	ConfigDesc       ocispec.Descriptor
 	Nonlayers        []ocispec.Descriptor
 	Remote           *solver.Remote
+
+	// Done releases the lease taken on the pulled manifests/config (if
+	// any) and, when set, runs the Puller's GarbageCollect hook
+	// afterwards. Callers should call Done once the pulled descriptors
+	// are pinned by some longer-lived reference (e.g. a cache record).
+	Done func(ctx context.Context) error
 }
 
 func (p *Puller) resolve(ctx context.Context) error {
@@ -68,7 +120,7 @@ func (p *Puller) tryLocalResolve(ctx context.Context) error {
 	}
 
 	if desc.Digest == "" {
-		return errors.New("empty digest")
+		return p.tryManifestStoreResolve(ctx)
 	}
 
 	info, err := p.ContentStore.Info(ctx, desc.Digest)
@@ -90,8 +142,115 @@ func (p *Puller) tryLocalResolve(ctx context.Context) error {
 	return nil
 }
 
-func (p *Puller) PullManifests(ctx context.Context) (*PulledManifests, error) {
-	err := p.resolve(ctx)
+// tryManifestStoreResolve serves a tag resolve out of the ManifestStore when
+// possible. It still performs a resolve against the registry to make sure the
+// tag hasn't moved, but skips it (trusting the cached manifest) if the
+// registry can't be reached, e.g. when building offline.
+func (p *Puller) tryManifestStoreResolve(ctx context.Context) error {
+	if p.ManifestStore == nil {
+		return errors.New("empty digest")
+	}
+
+	ref := p.Src.String()
+	cachedDesc, _, ok := p.ManifestStore.Get(ctx, ref)
+	if !ok {
+		return errors.Errorf("no cached manifest for %s", ref)
+	}
+
+	_, latestDesc, err := p.Resolver.Resolve(ctx, ref)
+	if err != nil {
+		if !isLikelyOffline(err) {
+			return err
+		}
+		// The registry couldn't be reached at all (as opposed to responding
+		// with e.g. an auth failure or a 404), so trust the cached manifest
+		// rather than failing the pull outright.
+		p.ref = ref
+		p.desc = cachedDesc
+		return nil
+	}
+	if latestDesc.Digest != cachedDesc.Digest {
+		return errors.Errorf("cached manifest for %s is stale", ref)
+	}
+
+	p.ref = ref
+	p.desc = cachedDesc
+	return nil
+}
+
+// isLikelyOffline reports whether err looks like the registry was
+// unreachable (DNS failure, connection refused, timeout) rather than a
+// response the registry actually sent back, such as an auth failure, a 404
+// for a deleted tag, or a rate limit. Only the former is safe to paper over
+// with a stale cached manifest; the latter should propagate so the caller
+// finds out the pull failed.
+func isLikelyOffline(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// withPullLease wraps ctx in a fresh lease when p.LeaseManager is set, so the
+// manifests/config fetched under it are pinned until the returned done func
+// is called. It returns a no-op done func otherwise.
+func (p *Puller) withPullLease(ctx context.Context) (context.Context, func(context.Context) error, error) {
+	if p.LeaseManager == nil {
+		return ctx, func(context.Context) error { return nil }, nil
+	}
+
+	ctx, rel, err := leaseutil.WithLease(ctx, p.LeaseManager, leaseutil.MakeTemporary)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create lease for pull")
+	}
+	var releaseOnce sync.Once
+	done := func(ctx context.Context) error {
+		var err error
+		releaseOnce.Do(func() {
+			if err = rel(ctx); err != nil {
+				return
+			}
+			if p.GarbageCollect != nil {
+				_, err = p.GarbageCollect(ctx)
+			}
+		})
+		return err
+	}
+	return ctx, done, nil
+}
+
+func (p *Puller) newFetcher(ctx context.Context) (remotes.Fetcher, error) {
+	fetcher, err := p.Resolver.Fetcher(ctx, p.ref)
+	if err != nil {
+		return nil, err
+	}
+	fetcher = &pullprogress.FetcherWithProgress{
+		Fetcher: fetcher,
+		Manager: p.ContentStore,
+	}
+	if p.ProgressWriter != nil {
+		fetcher = &progressFetcher{
+			Fetcher: fetcher,
+			writer:  p.ProgressWriter,
+			limiter: rate.NewLimiter(rate.Every(progressUpdateInterval), 1),
+		}
+	}
+	return fetcher, nil
+}
+
+func (p *Puller) PullManifests(ctx context.Context) (_ *PulledManifests, retErr error) {
+	ctx, done, err := p.withPullLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure the lease (and any GarbageCollect hook) is released on every
+	// error path, not just the happy one below that hands it off via
+	// PulledManifests.Done.
+	defer func() {
+		if retErr != nil {
+			done(ctx)
+		}
+	}()
+
+	err = p.resolve(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +265,7 @@ func (p *Puller) PullManifests(ctx context.Context) (*PulledManifests, error) {
 	// or 2) cachemanager should manage the contentstore
 	var handlers []images.Handler
 
-	fetcher, err := p.Resolver.Fetcher(ctx, p.ref)
+	fetcher, err := p.newFetcher(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -115,10 +274,7 @@ func (p *Puller) PullManifests(ctx context.Context) (*PulledManifests, error) {
 	if p.desc.MediaType == images.MediaTypeDockerSchema1Manifest {
 		// schema1 images are not lazy at this time, the converter will pull the whole image
 		// including layer blobs
-		schema1Converter = schema1.NewConverter(p.ContentStore, &pullprogress.FetcherWithProgress{
-			Fetcher: fetcher,
-			Manager: p.ContentStore,
-		})
+		schema1Converter = schema1.NewConverter(p.ContentStore, fetcher)
 		handlers = append(handlers, schema1Converter)
 	} else {
 		// Get all the children for a descriptor
@@ -174,6 +330,12 @@ func (p *Puller) PullManifests(ctx context.Context) (*PulledManifests, error) {
 		return nil, err
 	}
 
+	if p.ManifestStore != nil {
+		if err := p.ManifestStore.Put(ctx, p.ref, p.desc); err != nil {
+			return nil, err
+		}
+	}
+
 	return &PulledManifests{
 		Ref:              p.ref,
 		MainManifestDesc: p.desc,
@@ -183,9 +345,218 @@ func (p *Puller) PullManifests(ctx context.Context) (*PulledManifests, error) {
 			Descriptors: p.layers,
 			Provider:    p,
 		},
+		Done: done,
 	}, nil
 }
 
+// PullAllManifests walks an OCI index once for every platform in
+// p.Platforms and returns a PulledManifests per matching platform, sharing
+// the manifest resolve, fetch and content-store writes. This replaces
+// constructing one Puller per platform, which re-resolves and re-dispatches
+// the shared parts of the index once per platform.
+func (p *Puller) PullAllManifests(ctx context.Context) (_ map[string]*PulledManifests, retErr error) {
+	if len(p.Platforms) == 0 {
+		return nil, errors.New("no platforms specified for PullAllManifests")
+	}
+
+	ctx, done, err := p.withPullLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure the lease (and any GarbageCollect hook) is released on every
+	// error path below, not just the happy one that hands it off via each
+	// returned PulledManifests.Done.
+	defer func() {
+		if retErr != nil {
+			done(ctx)
+		}
+	}()
+
+	if err := p.resolve(ctx); err != nil {
+		return nil, err
+	}
+
+	matcher := platforms.Any(p.Platforms...)
+
+	var mu sync.Mutex // images.Dispatch calls handlers in parallel
+	metadata := make(map[digest.Digest]ocispec.Descriptor)
+
+	fetcher, err := p.newFetcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	childrenHandler := images.ChildrenHandler(p.ContentStore)
+	childrenHandler = images.FilterPlatforms(childrenHandler, matcher)
+
+	dslHandler, err := docker.AppendDistributionSourceLabel(p.ContentStore, p.ref)
+	if err != nil {
+		return nil, err
+	}
+
+	handlers := images.Handlers(
+		filterLayerBlobs(metadata, &mu),
+		remotes.FetchHandler(p.ContentStore, fetcher),
+		childrenHandler,
+		dslHandler,
+	)
+
+	if err := images.Dispatch(ctx, handlers, nil, p.desc); err != nil {
+		return nil, err
+	}
+
+	manifestDescs, err := childManifests(ctx, p.ContentStore, p.desc, matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.ManifestStore != nil {
+		if err := p.ManifestStore.Put(ctx, p.ref, p.desc); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(manifestDescs) == 0 {
+		// Nothing will be handed a Done to call; release now instead of
+		// leaking the lease.
+		done(ctx)
+		return map[string]*PulledManifests{}, nil
+	}
+
+	// Every platform's PulledManifests shares the one lease taken out above,
+	// so releasing it has to wait until every platform's caller has called
+	// its own Done, the same way groupEntry refcounts Done across callers
+	// that share a deduped pull: otherwise the first platform done
+	// processing (e.g. the first to pin its cache record) would release —
+	// and potentially GC — the other platforms' still-unpinned content.
+	platDone := refCountedDone(done, len(manifestDescs))
+
+	out := make(map[string]*PulledManifests, len(manifestDescs))
+	for _, manifestDesc := range manifestDescs {
+		// This just gathers metadata about the descriptors making up this
+		// manifest, it does not fetch anything new: the shared dispatch
+		// above already wrote everything matching any requested platform.
+		// The platform filter here is the broad matcher, not a single
+		// platform, since the real platform for a bare (non-index) manifest
+		// isn't known until its config is read below.
+		platMetadata := make(map[digest.Digest]ocispec.Descriptor)
+		if err := images.Dispatch(ctx, images.Handlers(
+			filterLayerBlobs(platMetadata, &mu),
+			images.FilterPlatforms(images.ChildrenHandler(p.ContentStore), matcher),
+		), nil, manifestDesc); err != nil {
+			return nil, err
+		}
+
+		var configDesc ocispec.Descriptor
+		nonlayers := make([]ocispec.Descriptor, 0, len(platMetadata))
+		for _, desc := range platMetadata {
+			nonlayers = append(nonlayers, desc)
+			switch desc.MediaType {
+			case images.MediaTypeDockerSchema2Config, ocispec.MediaTypeImageConfig:
+				configDesc = desc
+			}
+		}
+
+		plat := manifestDesc.Platform
+		if plat == nil {
+			// An index entry already carries its own Platform; a bare,
+			// single manifest (no enclosing index) doesn't, so read it out
+			// of the image config instead of assuming p.Platform, which may
+			// not even be one of the platforms this call was asked for.
+			resolved, err := readConfigPlatform(ctx, p.ContentStore, configDesc)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to determine platform of %s", manifestDesc.Digest)
+			}
+			plat = resolved
+		}
+		if !matcher.Match(*plat) {
+			return nil, errors.Errorf("manifest %s is for platform %s, which was not requested", manifestDesc.Digest, platforms.Format(*plat))
+		}
+
+		layers, err := getLayers(ctx, p.ContentStore, manifestDesc, platforms.Only(*plat))
+		if err != nil {
+			return nil, err
+		}
+
+		out[platforms.Format(*plat)] = &PulledManifests{
+			Ref:              p.ref,
+			MainManifestDesc: manifestDesc,
+			ConfigDesc:       configDesc,
+			Nonlayers:        nonlayers,
+			Remote: &solver.Remote{
+				Descriptors: layers,
+				Provider:    p,
+			},
+			Done: platDone,
+		}
+	}
+
+	return out, nil
+}
+
+// refCountedDone wraps done so it only actually runs once it has been called
+// n times. It's used to share one underlying release (a lease, typically)
+// across n independently-returned callers, none of which should be able to
+// release it on behalf of the others.
+func refCountedDone(done func(context.Context) error, n int) func(context.Context) error {
+	var mu sync.Mutex
+	pending := n
+	return func(ctx context.Context) error {
+		mu.Lock()
+		pending--
+		release := pending == 0
+		mu.Unlock()
+		if !release {
+			return nil
+		}
+		return done(ctx)
+	}
+}
+
+// readConfigPlatform reads the OS/Architecture/Variant a manifest's config
+// blob was built for. It's needed for a manifest that doesn't carry its own
+// Platform: index entries do, but a bare (non-index) manifest doesn't, even
+// though the same information is always present in its config.
+func readConfigPlatform(ctx context.Context, provider content.Provider, configDesc ocispec.Descriptor) (*ocispec.Platform, error) {
+	dt, err := content.ReadBlob(ctx, provider, configDesc)
+	if err != nil {
+		return nil, err
+	}
+	var img ocispec.Image
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal image config")
+	}
+	return &ocispec.Platform{
+		OS:           img.OS,
+		Architecture: img.Architecture,
+		Variant:      img.Variant,
+	}, nil
+}
+
+// childManifests returns the manifest descriptors matching matcher that desc
+// points at: desc itself if it is already a single-platform manifest, or the
+// matching entries of its index if it is a manifest list/index.
+func childManifests(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, matcher platforms.MatchComparer) ([]ocispec.Descriptor, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+	default:
+		return []ocispec.Descriptor{desc}, nil
+	}
+
+	children, err := images.Children(ctx, provider, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []ocispec.Descriptor
+	for _, child := range children {
+		if child.Platform == nil || matcher.Match(*child.Platform) {
+			out = append(out, child)
+		}
+	}
+	return out, nil
+}
+
 func (p *Puller) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
 	err := p.resolve(ctx)
 	if err != nil {
@@ -242,3 +613,59 @@ func getLayers(ctx context.Context, provider content.Provider, desc ocispec.Desc
 	}
 	return layers, nil
 }
+
+// fetchProgress is the value progressFetcher reports to a progress.Writer
+// for each blob it fetches.
+type fetchProgress struct {
+	Current int64
+	Total   int64
+}
+
+// progressFetcher reports fetch progress for each blob a remotes.Fetcher
+// fetches, keyed by the blob's digest. It's a plain wrapper around the
+// fetcher rather than something pullprogress.FetcherWithProgress does for
+// us, since that type only hooks the content.Store write path, not a
+// progress.Writer.
+type progressFetcher struct {
+	remotes.Fetcher
+	writer  progress.Writer
+	limiter *rate.Limiter
+}
+
+func (f *progressFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.Fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &progressReadCloser{
+		ReadCloser: rc,
+		id:         desc.Digest.String(),
+		total:      desc.Size,
+		writer:     f.writer,
+		limiter:    f.limiter,
+	}, nil
+}
+
+// progressReadCloser reports fetchProgress to writer as the wrapped blob is
+// read. Intermediate reads are coalesced through limiter so a fast registry
+// doesn't flood the UI with one update per read, but the read that reaches
+// EOF always reports, bypassing the limiter: dropping that one the way an
+// intermediate update can be dropped would leave the UI showing the blob as
+// stuck mid-fetch forever.
+type progressReadCloser struct {
+	io.ReadCloser
+	id      string
+	total   int64
+	current int64
+	writer  progress.Writer
+	limiter *rate.Limiter
+}
+
+func (r *progressReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.current += int64(n)
+	if err == io.EOF || r.limiter.Allow() {
+		r.writer.Write(r.id, fetchProgress{Current: r.current, Total: r.total})
+	}
+	return n, err
+}
@@ -0,0 +1,187 @@
+package pull
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/gc"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+func TestWithPullLeaseNoLeaseManager(t *testing.T) {
+	p := &Puller{}
+
+	ctx := context.Background()
+	gotCtx, done, err := p.withPullLease(ctx)
+	if err != nil {
+		t.Fatalf("withPullLease returned error: %v", err)
+	}
+	if gotCtx != ctx {
+		t.Fatal("expected ctx to be returned unchanged when LeaseManager is nil")
+	}
+	if done == nil {
+		t.Fatal("expected a non-nil done func")
+	}
+	if err := done(ctx); err != nil {
+		t.Fatalf("done() returned error: %v", err)
+	}
+}
+
+func TestWithPullLeaseSkipsGarbageCollectWithoutLease(t *testing.T) {
+	var released bool
+	p := &Puller{
+		GarbageCollect: func(ctx context.Context) (gc.Stats, error) {
+			released = true
+			return gc.Stats{}, nil
+		},
+	}
+
+	// Without a LeaseManager, GarbageCollect is never wired up by
+	// withPullLease: it is only invoked by the done func returned once a
+	// lease exists. This just documents that expectation.
+	ctx := context.Background()
+	_, done, err := p.withPullLease(ctx)
+	if err != nil {
+		t.Fatalf("withPullLease returned error: %v", err)
+	}
+	if err := done(ctx); err != nil {
+		t.Fatalf("done() returned error: %v", err)
+	}
+	if released {
+		t.Fatal("GarbageCollect should not run when there was never a lease to release")
+	}
+}
+
+type fakeNetError struct{ error }
+
+func (fakeNetError) Timeout() bool   { return true }
+func (fakeNetError) Temporary() bool { return true }
+
+func TestIsLikelyOffline(t *testing.T) {
+	netErr := fakeNetError{errors.New("dial tcp: connect: connection refused")}
+	if !isLikelyOffline(netErr) {
+		t.Fatal("expected a net.Error to be classified as offline")
+	}
+	if !isLikelyOffline(errors.Wrap(netErr, "resolve failed")) {
+		t.Fatal("expected a wrapped net.Error to be classified as offline")
+	}
+
+	var _ net.Error = netErr // sanity check the fake actually satisfies net.Error
+
+	if isLikelyOffline(errors.New("unexpected status code 401 Unauthorized")) {
+		t.Fatal("expected a registry-returned error not to be classified as offline")
+	}
+}
+
+type recordingWriter struct {
+	writes []fetchProgress
+}
+
+func (w *recordingWriter) Write(id string, value interface{}) error {
+	w.writes = append(w.writes, value.(fetchProgress))
+	return nil
+}
+
+func (w *recordingWriter) Close() error { return nil }
+
+type nopReadCloser struct{ io.Reader }
+
+func (nopReadCloser) Close() error { return nil }
+
+func TestProgressReadCloserAlwaysReportsCompletion(t *testing.T) {
+	w := &recordingWriter{}
+	rc := &progressReadCloser{
+		ReadCloser: nopReadCloser{bytes.NewReader([]byte("hello"))},
+		id:         "sha256:deadbeef",
+		total:      5,
+		writer:     w,
+		// A limiter that never allows anything makes sure the completion
+		// report on EOF bypasses it rather than getting dropped.
+		limiter: rate.NewLimiter(0, 0),
+	}
+
+	buf := make([]byte, 5)
+	if _, err := rc.Read(buf); err != nil {
+		t.Fatalf("unexpected error reading body: %v", err)
+	}
+	if _, err := rc.Read(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	if len(w.writes) == 0 {
+		t.Fatal("expected a progress write to be reported on EOF even with an exhausted limiter")
+	}
+	last := w.writes[len(w.writes)-1]
+	if last.Current != 5 || last.Total != 5 {
+		t.Fatalf("expected final progress to report 5/5, got %+v", last)
+	}
+}
+
+type fakeProvider struct {
+	blobs map[digest.Digest][]byte
+}
+
+func (p fakeProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	b, ok := p.blobs[desc.Digest]
+	if !ok {
+		return nil, errors.Errorf("blob not found: %s", desc.Digest)
+	}
+	return &fakeReaderAt{b: b}, nil
+}
+
+type fakeReaderAt struct{ b []byte }
+
+func (r *fakeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(r.b).ReadAt(p, off)
+}
+func (r *fakeReaderAt) Close() error { return nil }
+func (r *fakeReaderAt) Size() int64  { return int64(len(r.b)) }
+
+func TestRefCountedDoneWaitsForEveryCaller(t *testing.T) {
+	var released int
+	done := func(context.Context) error {
+		released++
+		return nil
+	}
+
+	platDone := refCountedDone(done, 3)
+
+	if err := platDone(context.Background()); err != nil {
+		t.Fatalf("platDone returned error: %v", err)
+	}
+	if err := platDone(context.Background()); err != nil {
+		t.Fatalf("platDone returned error: %v", err)
+	}
+	if released != 0 {
+		t.Fatalf("expected no release before every caller is done, got %d releases", released)
+	}
+
+	if err := platDone(context.Background()); err != nil {
+		t.Fatalf("platDone returned error: %v", err)
+	}
+	if released != 1 {
+		t.Fatalf("expected exactly one release once every caller is done, got %d", released)
+	}
+}
+
+func TestReadConfigPlatform(t *testing.T) {
+	cfg := []byte(`{"os":"linux","architecture":"arm64","variant":"v8"}`)
+	d := digest.FromBytes(cfg)
+	desc := ocispec.Descriptor{Digest: d, Size: int64(len(cfg))}
+	provider := fakeProvider{blobs: map[digest.Digest][]byte{d: cfg}}
+
+	plat, err := readConfigPlatform(context.Background(), provider, desc)
+	if err != nil {
+		t.Fatalf("readConfigPlatform returned error: %v", err)
+	}
+	if plat.OS != "linux" || plat.Architecture != "arm64" || plat.Variant != "v8" {
+		t.Fatalf("unexpected platform: %+v", plat)
+	}
+}